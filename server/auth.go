@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// RoomAuth is one room's token requirements, as loaded from a token config
+// file. TokenHash gates joining the room at all; HostTokenHash additionally
+// gates a "host": true handshake. Both are hex-encoded SHA-256 hashes, never
+// the raw token.
+type RoomAuth struct {
+	TokenHash     string `json:"token_hash"`
+	HostTokenHash string `json:"host_token_hash,omitempty"`
+}
+
+// TokenConfig maps room ID to its auth requirements. A nil TokenConfig (the
+// Server default) disables token auth entirely, so existing handshakes with
+// no "token" field keep working.
+type TokenConfig map[string]RoomAuth
+
+// LoadTokenConfig reads a JSON file shaped like:
+//
+//	{"den": {"token_hash": "<sha256 hex>", "host_token_hash": "<sha256 hex>"}}
+//
+// mapping room IDs to the SHA-256 hash of the token(s) required to use them.
+func LoadTokenConfig(path string) (TokenConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg TokenConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing token config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// hashToken returns the hex-encoded SHA-256 hash of token, the form stored
+// in the token config file.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkToken reports whether token hashes to wantHash, using a
+// constant-time comparison so a wrong guess doesn't leak timing
+// information. An empty wantHash (no token configured) never matches.
+func checkToken(token, wantHash string) bool {
+	if wantHash == "" {
+		return false
+	}
+	got := hashToken(token)
+	return subtle.ConstantTimeCompare([]byte(got), []byte(wantHash)) == 1
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// generateTestCert builds a throwaway self-signed TLS certificate for
+// "127.0.0.1", valid for the duration of the test run.
+func generateTestCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating test key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "live-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating test certificate: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("loading test keypair: %v", err)
+	}
+	return cert
+}
+
+// startTestTLSServer starts a Server behind a TLS listener, returning it and
+// the address to dial.
+func startTestTLSServer(t *testing.T) (*Server, string) {
+	t.Helper()
+
+	server := NewServer()
+	go server.run()
+
+	cert := generateTestCert(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("starting TLS listener: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleConnection(conn)
+		}
+	}()
+	return server, listener.Addr().String()
+}
+
+func TestTLSHandshake(t *testing.T) {
+	_, addr := startTestTLSServer(t)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("dialing TLS server: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintln(conn, `{"event": "handshake", "name": "tls-client", "room": "den"}`)
+	reply, _ := bufio.NewReader(conn).ReadString('\n')
+	if !strings.Contains(reply, "handshake_response") {
+		t.Fatalf("expected handshake_response over TLS, got: %s", reply)
+	}
+}
+
+func TestTLSMalformedClientHelloDoesNotPanic(t *testing.T) {
+	_, addr := startTestTLSServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dialing TLS server: %v", err)
+	}
+	defer conn.Close()
+
+	// Not a TLS ClientHello; the listener should fail the handshake and
+	// close the connection rather than panic or hang.
+	conn.Write([]byte("not a tls client hello\n"))
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	conn.Read(buf) // either an error or EOF; just must not hang or panic
+}
+
+func TestTokenGatedHandshake(t *testing.T) {
+	server, addr := startTestServer()
+	server.Tokens = TokenConfig{
+		"den": {
+			TokenHash:     hashToken("room-secret"),
+			HostTokenHash: hashToken("host-secret"),
+		},
+	}
+
+	t.Run("valid token joins", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", addr)
+		defer conn.Close()
+		fmt.Fprintln(conn, `{"event": "handshake", "name": "alice", "room": "den", "token": "room-secret"}`)
+
+		reply, _ := bufio.NewReader(conn).ReadString('\n')
+		if !strings.Contains(reply, "handshake_response") {
+			t.Fatalf("expected handshake_response with a valid token, got: %s", reply)
+		}
+	})
+
+	t.Run("invalid token is rejected and connection dropped", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", addr)
+		defer conn.Close()
+		fmt.Fprintln(conn, `{"event": "handshake", "name": "mallory", "room": "den", "token": "wrong"}`)
+
+		reader := bufio.NewReader(conn)
+		reply, _ := reader.ReadString('\n')
+		if !strings.Contains(reply, "Invalid token") {
+			t.Fatalf("expected an Invalid token error, got: %s", reply)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, err := reader.ReadString('\n'); err == nil {
+			t.Error("expected connection to be dropped after an invalid token")
+		}
+	})
+
+	t.Run("host claim without host token is rejected and dropped", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", addr)
+		defer conn.Close()
+		fmt.Fprintln(conn, `{"event": "handshake", "name": "bob", "room": "den", "token": "room-secret", "host": true}`)
+
+		reader := bufio.NewReader(conn)
+		reply, _ := reader.ReadString('\n')
+		if !strings.Contains(reply, "Invalid host token") {
+			t.Fatalf("expected an Invalid host token error, got: %s", reply)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, err := reader.ReadString('\n'); err == nil {
+			t.Error("expected connection to be dropped after an invalid host token")
+		}
+	})
+
+	t.Run("host claim with valid host token succeeds", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", addr)
+		defer conn.Close()
+		fmt.Fprintln(conn, `{"event": "handshake", "name": "carol", "room": "den", "token": "room-secret", "host": true, "host_token": "host-secret"}`)
+
+		reply, _ := bufio.NewReader(conn).ReadString('\n')
+		if !strings.Contains(reply, `"is_host":true`) {
+			t.Fatalf("expected is_host:true with a valid host token, got: %s", reply)
+		}
+	})
+}
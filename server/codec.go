@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Frame type tags for the binary wire format. A frame is
+// [1 byte type][4 byte big-endian length][payload]. Most types just carry
+// a JSON-encoded event map as payload (the type byte is a routing hint, the
+// "event" field inside still carries the real meaning); cursor_move and
+// content_patch skip JSON entirely for the payloads that matter for size.
+const (
+	FrameHandshake byte = iota + 1
+	FrameCursorMove
+	FrameContentPatch
+	FrameRequest
+	FrameResponse
+	FramePing
+	FrameError
+	// FrameEvent is a catch-all for messages with no dedicated frame type
+	// (presence notifications, room directory admin events).
+	FrameEvent
+)
+
+// cursorFrameSize is the fixed binary layout of a cursor_move frame:
+// id:uint32, x:int32, y:int32, flags:uint32.
+const cursorFrameSize = 16
+
+// Codec reads and writes the generic event map used throughout the server
+// for one connection's wire format. Exactly one codec is chosen per
+// connection, by sniffing its first byte: '{' is JSON, anything else is
+// framed binary.
+type Codec interface {
+	// ReadMessage reads and decodes the next message from r. An error
+	// wrapping decodeError means the frame was read fine but its payload
+	// couldn't be decoded; any other error is a read/framing failure and the
+	// connection should be dropped.
+	ReadMessage(r *bufio.Reader) (map[string]any, error)
+	// EncodeMessage serializes data for sending to client. client is needed
+	// because BinaryCodec picks the request/response frame type based on
+	// whether the recipient is the room host.
+	EncodeMessage(client *Client, data map[string]any) ([]byte, error)
+}
+
+// decodeError marks a message whose frame was read off the wire intact but
+// whose payload failed to decode (bad JSON, wrong-size cursor frame). The
+// caller should log and keep the connection open, unlike a read/framing
+// error.
+type decodeError struct{ err error }
+
+func (e *decodeError) Error() string { return e.err.Error() }
+func (e *decodeError) Unwrap() error { return e.err }
+
+// detectCodec peeks the connection's first byte to choose a codec without
+// consuming it.
+func detectCodec(r *bufio.Reader) (Codec, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] == '{' {
+		return JSONCodec{}, nil
+	}
+	return BinaryCodec{}, nil
+}
+
+// JSONCodec is the original wire format: one JSON object per line.
+type JSONCodec struct{}
+
+func (JSONCodec) ReadMessage(r *bufio.Reader) (map[string]any, error) {
+	line, err := readLineLimited(r, MaxBufferSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg map[string]any
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return nil, &decodeError{err}
+	}
+	return msg, nil
+}
+
+func (JSONCodec) EncodeMessage(_ *Client, data map[string]any) ([]byte, error) {
+	// content_patch content arrives as []byte when a binary sender's frame
+	// is transcoded for a JSON recipient; json.Marshal would otherwise
+	// base64-encode a []byte instead of writing it as text.
+	if content, ok := data["content"].([]byte); ok {
+		withContent := make(map[string]any, len(data))
+		for k, v := range data {
+			withContent[k] = v
+		}
+		withContent["content"] = string(content)
+		data = withContent
+	}
+
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return append(bytes, '\n'), nil
+}
+
+// readLineLimited reads up to the next '\n' (exclusive), mirroring
+// bufio.Scanner's ScanLines but bailing out with bufio.ErrTooLong instead of
+// buffering an unbounded line.
+func readLineLimited(r *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return nil, bufio.ErrTooLong
+		}
+		if err == nil {
+			return line[:len(line)-1], nil
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// BinaryCodec is the length-prefixed binary wire format.
+type BinaryCodec struct{}
+
+func (BinaryCodec) ReadMessage(r *bufio.Reader) (map[string]any, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	frameType := header[0]
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > MaxBufferSize {
+		return nil, bufio.ErrTooLong
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	return decodeFrame(frameType, payload)
+}
+
+func (BinaryCodec) EncodeMessage(client *Client, data map[string]any) ([]byte, error) {
+	switch data["event"] {
+	case "cursor_move":
+		return encodeCursorFrame(data)
+	case "update_content":
+		return encodeContentPatchFrame(data), nil
+	case "ping":
+		return frame(FramePing, nil), nil
+	case "error":
+		return jsonFrame(FrameError, data)
+	case "handshake", "handshake_response":
+		return jsonFrame(FrameHandshake, data)
+	}
+
+	if _, hasRequestID := data["request_id"]; hasRequestID {
+		// Routed to the host, it's an app request waiting on a reply;
+		// routed anywhere else, it's the host's reply coming back.
+		if client.IsHost {
+			return jsonFrame(FrameRequest, data)
+		}
+		return jsonFrame(FrameResponse, data)
+	}
+
+	return jsonFrame(FrameEvent, data)
+}
+
+func decodeFrame(frameType byte, payload []byte) (map[string]any, error) {
+	switch frameType {
+	case FrameCursorMove:
+		return decodeCursorFrame(payload)
+	case FrameContentPatch:
+		// No JSON re-encoding: the payload is the new content verbatim.
+		// Attribution (from_id/name) is filled in by Room.processMessage
+		// same as for the JSON path, so nothing is lost server-side; it's
+		// just not echoed back over this frame type.
+		return map[string]any{"event": "update_content", "content": payload}, nil
+	case FramePing:
+		return map[string]any{"event": "ping"}, nil
+	default:
+		var msg map[string]any
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return nil, &decodeError{err}
+		}
+		return msg, nil
+	}
+}
+
+func encodeCursorFrame(data map[string]any) ([]byte, error) {
+	pos, _ := data["position"].([]any)
+	if len(pos) != 2 {
+		return nil, fmt.Errorf("cursor_move frame: position must have 2 elements, got %d", len(pos))
+	}
+	x, _ := pos[0].(float64)
+	y, _ := pos[1].(float64)
+
+	var id uint32
+	if fromID, ok := data["from_id"].(float64); ok {
+		id = uint32(fromID)
+	}
+	var flags uint32
+	if f, ok := data["flags"].(float64); ok {
+		flags = uint32(f)
+	}
+
+	payload := make([]byte, cursorFrameSize)
+	binary.BigEndian.PutUint32(payload[0:4], id)
+	binary.BigEndian.PutUint32(payload[4:8], uint32(int32(x)))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(int32(y)))
+	binary.BigEndian.PutUint32(payload[12:16], flags)
+
+	return frame(FrameCursorMove, payload), nil
+}
+
+func decodeCursorFrame(payload []byte) (map[string]any, error) {
+	if len(payload) != cursorFrameSize {
+		return nil, &decodeError{fmt.Errorf("cursor_move frame: want %d bytes, got %d", cursorFrameSize, len(payload))}
+	}
+
+	id := binary.BigEndian.Uint32(payload[0:4])
+	x := int32(binary.BigEndian.Uint32(payload[4:8]))
+	y := int32(binary.BigEndian.Uint32(payload[8:12]))
+	flags := binary.BigEndian.Uint32(payload[12:16])
+
+	return map[string]any{
+		"event":    "cursor_move",
+		"position": []any{float64(x), float64(y)},
+		"from_id":  float64(id),
+		"flags":    float64(flags),
+	}, nil
+}
+
+func encodeContentPatchFrame(data map[string]any) []byte {
+	var content []byte
+	switch v := data["content"].(type) {
+	case []byte:
+		content = v
+	case string:
+		content = []byte(v)
+	}
+	return frame(FrameContentPatch, content)
+}
+
+func frame(frameType byte, payload []byte) []byte {
+	buf := make([]byte, 5+len(payload))
+	buf[0] = frameType
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	copy(buf[5:], payload)
+	return buf
+}
+
+func jsonFrame(frameType byte, data map[string]any) ([]byte, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return frame(frameType, payload), nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// writeBinaryFrame writes one [type][length][payload] frame to conn.
+func writeBinaryFrame(conn net.Conn, frameType byte, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := conn.Write(header); err != nil {
+		return err
+	}
+	_, err := conn.Write(payload)
+	return err
+}
+
+// readBinaryFrame reads one frame's type and payload off r.
+func readBinaryFrame(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+func binaryHandshake(name, room string, host bool) []byte {
+	payload, _ := json.Marshal(map[string]any{
+		"event": "handshake", "name": name, "room": room, "host": host,
+	})
+	return payload
+}
+
+func TestBinaryCursorFrameRoundTrip(t *testing.T) {
+	encoded, err := encodeCursorFrame(map[string]any{
+		"event":    "cursor_move",
+		"position": []any{float64(-12), float64(34)},
+		"from_id":  float64(7),
+		"flags":    float64(1),
+	})
+	if err != nil {
+		t.Fatalf("encodeCursorFrame: %v", err)
+	}
+
+	msg, err := (BinaryCodec{}).ReadMessage(bufio.NewReader(bytes.NewReader(encoded)))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+
+	pos, _ := msg["position"].([]any)
+	if len(pos) != 2 || pos[0].(float64) != -12 || pos[1].(float64) != 34 {
+		t.Errorf("position = %v, want [-12 34]", pos)
+	}
+	if msg["from_id"].(float64) != 7 {
+		t.Errorf("from_id = %v, want 7", msg["from_id"])
+	}
+}
+
+func TestBinaryContentPatchSkipsJSONReencoding(t *testing.T) {
+	content := []byte(`raw "content" with quotes and 日本語`)
+	encoded := encodeContentPatchFrame(map[string]any{"event": "update_content", "content": content})
+
+	// The payload is the content bytes verbatim: no quoting, no escaping.
+	if payload := encoded[5:]; !bytes.Equal(payload, content) {
+		t.Errorf("content_patch payload = %q, want verbatim %q", payload, content)
+	}
+
+	msg, err := (BinaryCodec{}).ReadMessage(bufio.NewReader(bytes.NewReader(encoded)))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if got, _ := msg["content"].([]byte); !bytes.Equal(got, content) {
+		t.Errorf("decoded content = %q, want %q", got, content)
+	}
+}
+
+func TestBinaryFrameFragmentation(t *testing.T) {
+	_, addr := startTestServer()
+
+	conn, _ := net.Dial("tcp", addr)
+	defer conn.Close()
+
+	payload := binaryHandshake("framed", "den", false)
+	header := make([]byte, 5)
+	header[0] = FrameHandshake
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	full := append(header, payload...)
+
+	// Dribble the frame out a few bytes at a time to exercise partial reads
+	// across the type byte, the length prefix, and the payload.
+	for i := 0; i < len(full); i += 3 {
+		end := min(i+3, len(full))
+		if _, err := conn.Write(full[i:end]); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frameType, _, err := readBinaryFrame(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatalf("reading handshake_response frame: %v", err)
+	}
+	if frameType != FrameHandshake {
+		t.Fatalf("response frame type = %d, want FrameHandshake", frameType)
+	}
+}
+
+func TestBinaryOversizedFrame(t *testing.T) {
+	_, addr := startTestServer()
+
+	conn, _ := net.Dial("tcp", addr)
+	defer conn.Close()
+
+	header := make([]byte, 5)
+	header[0] = FrameHandshake
+	binary.BigEndian.PutUint32(header[1:], MaxBufferSize+1)
+	conn.Write(header)
+
+	// The oversized length is rejected before the server ever reads a
+	// payload, so the connection should be closed out from under us.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection to be closed after an oversized frame, got err = %v", err)
+	}
+}
+
+func TestMixedCodecRoomTranscoding(t *testing.T) {
+	_, addr := startTestServer()
+
+	// JSON client joins first.
+	jsonConn, _ := net.Dial("tcp", addr)
+	defer jsonConn.Close()
+	fmt.Fprintln(jsonConn, `{"event": "handshake", "name": "jsonner", "room": "den"}`)
+	jsonReader := bufio.NewReader(jsonConn)
+	jsonReader.ReadString('\n') // handshake_response
+	jsonReader.ReadString('\n') // own user_joined
+
+	// Binary client joins the same room.
+	binConn, _ := net.Dial("tcp", addr)
+	defer binConn.Close()
+	if err := writeBinaryFrame(binConn, FrameHandshake, binaryHandshake("binner", "den", false)); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	binReader := bufio.NewReader(binConn)
+	if _, _, err := readBinaryFrame(binReader); err != nil { // handshake_response
+		t.Fatalf("reading handshake_response: %v", err)
+	}
+	if _, _, err := readBinaryFrame(binReader); err != nil { // own user_joined
+		t.Fatalf("reading user_joined: %v", err)
+	}
+	jsonReader.ReadString('\n') // jsonner's view of binner's user_joined
+
+	// JSON -> binary: cursor_move should arrive framed with the fixed
+	// 16-byte cursor layout, not JSON.
+	fmt.Fprintln(jsonConn, `{"event": "cursor_move", "position": [5, 9]}`)
+
+	binConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frameType, payload, err := readBinaryFrame(binReader)
+	if err != nil {
+		t.Fatalf("reading transcoded cursor_move: %v", err)
+	}
+	if frameType != FrameCursorMove {
+		t.Fatalf("frame type = %d, want FrameCursorMove", frameType)
+	}
+	if len(payload) != cursorFrameSize {
+		t.Fatalf("cursor payload len = %d, want %d", len(payload), cursorFrameSize)
+	}
+	x := int32(binary.BigEndian.Uint32(payload[4:8]))
+	y := int32(binary.BigEndian.Uint32(payload[8:12]))
+	if x != 5 || y != 9 {
+		t.Errorf("cursor position = (%d, %d), want (5, 9)", x, y)
+	}
+
+	// Binary -> JSON: content_patch should arrive as plain JSON text, not
+	// a base64-wrapped byte slice.
+	if err := writeBinaryFrame(binConn, FrameContentPatch, []byte("hello from binary")); err != nil {
+		t.Fatalf("content_patch: %v", err)
+	}
+
+	jsonConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, err := jsonReader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading transcoded update_content: %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal([]byte(reply), &decoded); err != nil {
+		t.Fatalf("unmarshal transcoded message: %v", err)
+	}
+	if decoded["content"] != "hello from binary" {
+		t.Errorf("content = %v, want plain text %q", decoded["content"], "hello from binary")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"expvar"
+	"html/template"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// clientSnapshot is a point-in-time view of one client for the /debug status
+// page.
+type clientSnapshot struct {
+	ID           int
+	Name         string
+	IsHost       bool
+	QueueDepth   int
+	QueueCap     int
+	LastActivity time.Time
+}
+
+// roomSnapshot is a point-in-time view of one room for the /debug status
+// page.
+type roomSnapshot struct {
+	ID      string
+	Clients []clientSnapshot
+}
+
+var statusPageTmpl = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html><head><title>live status</title></head><body>
+<h1>live status</h1>
+{{range .}}
+<h2>room {{.ID}}</h2>
+<table border="1" cellpadding="4">
+<tr><th>id</th><th>name</th><th>host</th><th>queue</th><th>last activity</th></tr>
+{{range .Clients}}
+<tr><td>{{.ID}}</td><td>{{.Name}}</td><td>{{.IsHost}}</td><td>{{.QueueDepth}}/{{.QueueCap}}</td><td>{{.LastActivity.Format "15:04:05"}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>no active rooms</p>
+{{end}}
+</body></html>
+`))
+
+// statusSnapshot walks every room and client under the server's (and each
+// room's) action goroutine, so the /debug page never races with connection
+// handling.
+func (s *Server) statusSnapshot() []roomSnapshot {
+	var rooms []roomSnapshot
+	s.sync(func() {
+		rooms = make([]roomSnapshot, 0, len(s.Rooms))
+		for id, room := range s.Rooms {
+			done := make(chan roomSnapshot, 1)
+			room.actions <- func() {
+				clients := make([]clientSnapshot, 0, len(room.Clients))
+				for _, c := range room.Clients {
+					clients = append(clients, clientSnapshot{
+						ID:           c.ID,
+						Name:         c.Name,
+						IsHost:       c.IsHost,
+						QueueDepth:   len(c.Send),
+						QueueCap:     cap(c.Send),
+						LastActivity: time.Unix(0, c.LastActivity.Load()),
+					})
+				}
+				done <- roomSnapshot{ID: id, Clients: clients}
+			}
+			rooms = append(rooms, <-done)
+		}
+	})
+	return rooms
+}
+
+func (s *Server) statusHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusPageTmpl.Execute(w, s.statusSnapshot())
+}
+
+// ListenAndServeDebug starts the /debug HTTP server (expvar, pprof, and a
+// status page) on addr. It blocks like http.ListenAndServe, so the caller
+// should run it in its own goroutine.
+func (s *Server) ListenAndServeDebug(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/", s.statusHandler)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,135 @@
+package main
+
+// HostElectionPolicy selects how a room picks a fallback host once the
+// current one leaves without an explicit transfer_host.
+type HostElectionPolicy int
+
+const (
+	// PolicyOldest promotes the client with the lowest ClientID, i.e. the
+	// one that has been in the room longest. This is the default.
+	PolicyOldest HostElectionPolicy = iota
+	// PolicyLongestIdle promotes whichever client has gone the longest
+	// without sending a message.
+	PolicyLongestIdle
+	// PolicyExplicit never auto-promotes: the room broadcasts "no_host"
+	// and any requests that would have gone to a host are queued until a
+	// client claims it via request_host or a host-claiming handshake.
+	PolicyExplicit
+)
+
+// electCandidate picks removeClient's fallback host according to the room's
+// HostElectionPolicy. Returns nil if no client should be auto-promoted
+// (PolicyExplicit, or an empty room). Must run on the room's action
+// goroutine.
+func (r *Room) electCandidate() *Client {
+	if r.HostElectionPolicy == PolicyExplicit {
+		return nil
+	}
+
+	var best *Client
+	for _, c := range r.Clients {
+		switch {
+		case best == nil:
+			best = c
+		case r.HostElectionPolicy == PolicyLongestIdle:
+			if c.LastActivity.Load() < best.LastActivity.Load() {
+				best = c
+			}
+		default: // PolicyOldest
+			if c.ID < best.ID {
+				best = c
+			}
+		}
+	}
+	return best
+}
+
+// setHost transfers host status to newHost: it demotes the current host (if
+// any), cancels requests that were already delivered to them (the old host
+// will never reply), flushes anything queued while the room had no host,
+// and announces the change. Must run on the room's action goroutine.
+func (r *Room) setHost(newHost *Client) {
+	if r.Host != nil {
+		r.Host.IsHost = false
+		r.cancelDeliveredRequests()
+	}
+
+	newHost.IsHost = true
+	r.Host = newHost
+
+	r.flushQueuedRequests(newHost)
+	r.broadcast(nil, map[string]any{"event": "new_host", "id": newHost.ID, "name": newHost.Name})
+}
+
+// cancelDeliveredRequests drops every pending request that was already sent
+// to a host, telling each waiting client to retry now that the host has
+// changed. Requests still queued (PolicyExplicit, never delivered) are left
+// alone for flushQueuedRequests.
+func (r *Room) cancelDeliveredRequests() {
+	for reqID, pending := range r.PendingRequests {
+		if !pending.Delivered {
+			continue
+		}
+
+		pending.Timer.Stop()
+		delete(r.PendingRequests, reqID)
+		r.server.Metrics.PendingRequests.Add(-1)
+
+		// Note: deliberately not "request_id" - that key also marks a
+		// live request/response frame for BinaryCodec, which this isn't.
+		if target, ok := r.Clients[pending.ClientID]; ok {
+			sendJSON(target, map[string]any{
+				"event": "host_changed", "failed_request_id": reqID,
+				"message": "Host changed before replying, please retry",
+			})
+		}
+	}
+}
+
+// flushQueuedRequests delivers every pending request that was never sent to
+// a host (queued under PolicyExplicit while the room had none) to the
+// room's new host.
+func (r *Room) flushQueuedRequests(host *Client) {
+	for _, pending := range r.PendingRequests {
+		if pending.Delivered {
+			continue
+		}
+		sendJSON(host, pending.Msg)
+		pending.Delivered = true
+	}
+}
+
+// handleTransferHost lets the current host hand host status to another
+// client in the room by ID.
+func (r *Room) handleTransferHost(sender *Client, msg map[string]any) {
+	if !sender.IsHost {
+		sendJSON(sender, map[string]any{"event": "error", "message": "Only the host can transfer host"})
+		return
+	}
+
+	targetIDFloat, ok := msg["target_id"].(float64)
+	if !ok {
+		sendJSON(sender, map[string]any{"event": "error", "message": "Invalid target_id"})
+		return
+	}
+
+	target, ok := r.Clients[int(targetIDFloat)]
+	if !ok {
+		sendJSON(sender, map[string]any{"event": "error", "message": "Unknown target_id"})
+		return
+	}
+
+	r.setHost(target)
+}
+
+// handleRequestHost lets any client ask to become host. With a current host
+// in place the request is just forwarded for them to approve (via
+// transfer_host); with no host - PolicyExplicit's steady state - the
+// requester claims it directly.
+func (r *Room) handleRequestHost(sender *Client, _ map[string]any) {
+	if r.Host == nil {
+		r.setHost(sender)
+		return
+	}
+	sendJSON(r.Host, map[string]any{"event": "request_host", "from_id": sender.ID, "name": sender.Name})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roomHost synchronously reads the current host's (id, name) for roomID, or
+// (-1, "") if the room has no host (or doesn't exist).
+func roomHost(server *Server, roomID string) (int, string) {
+	type result struct {
+		id   int
+		name string
+	}
+	done := make(chan result)
+	server.actions <- func() {
+		room, ok := server.Rooms[roomID]
+		if !ok {
+			done <- result{-1, ""}
+			return
+		}
+		room.actions <- func() {
+			if room.Host == nil {
+				done <- result{-1, ""}
+				return
+			}
+			done <- result{room.Host.ID, room.Host.Name}
+		}
+	}
+	r := <-done
+	return r.id, r.name
+}
+
+func waitForHost(t *testing.T, server *Server, roomID, wantName string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, name := roomHost(server, roomID); name == wantName {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, got := roomHost(server, roomID)
+	t.Fatalf("host = %q, want %q", got, wantName)
+}
+
+func TestHostElectionPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy HostElectionPolicy
+		run    func(t *testing.T, server *Server, addr string)
+	}{
+		{
+			name:   "PolicyOldest promotes the lowest ClientID",
+			policy: PolicyOldest,
+			run: func(t *testing.T, server *Server, addr string) {
+				host, _ := net.Dial("tcp", addr)
+				fmt.Fprintln(host, `{"event": "handshake", "name": "host", "host": true, "room": "den"}`)
+				bufio.NewReader(host).ReadString('\n')
+
+				// a gets a lower ClientID than b, since it joins first.
+				a, _ := net.Dial("tcp", addr)
+				defer a.Close()
+				fmt.Fprintln(a, `{"event": "handshake", "name": "a", "room": "den"}`)
+				bufio.NewReader(a).ReadString('\n')
+
+				b, _ := net.Dial("tcp", addr)
+				defer b.Close()
+				fmt.Fprintln(b, `{"event": "handshake", "name": "b", "room": "den"}`)
+				bufio.NewReader(b).ReadString('\n')
+
+				host.Close()
+				waitForHost(t, server, "den", "a")
+			},
+		},
+		{
+			name:   "PolicyLongestIdle promotes the least recently active client",
+			policy: PolicyLongestIdle,
+			run: func(t *testing.T, server *Server, addr string) {
+				host, _ := net.Dial("tcp", addr)
+				fmt.Fprintln(host, `{"event": "handshake", "name": "host", "host": true, "room": "den"}`)
+				bufio.NewReader(host).ReadString('\n')
+
+				// idle never sends anything after its handshake.
+				idle, _ := net.Dial("tcp", addr)
+				defer idle.Close()
+				fmt.Fprintln(idle, `{"event": "handshake", "name": "idle", "room": "den"}`)
+				bufio.NewReader(idle).ReadString('\n')
+
+				active, _ := net.Dial("tcp", addr)
+				defer active.Close()
+				fmt.Fprintln(active, `{"event": "handshake", "name": "active", "room": "den"}`)
+				bufio.NewReader(active).ReadString('\n')
+
+				// Keep refreshing active's LastActivity so it's never the
+				// most idle client in the room.
+				for i := 0; i < 5; i++ {
+					time.Sleep(20 * time.Millisecond)
+					fmt.Fprintln(active, `{"event": "cursor_move", "position": [1,2]}`)
+				}
+
+				host.Close()
+				waitForHost(t, server, "den", "idle")
+			},
+		},
+		{
+			name:   "PolicyExplicit never auto-promotes",
+			policy: PolicyExplicit,
+			run: func(t *testing.T, server *Server, addr string) {
+				host, _ := net.Dial("tcp", addr)
+				fmt.Fprintln(host, `{"event": "handshake", "name": "host", "host": true, "room": "den"}`)
+				bufio.NewReader(host).ReadString('\n')
+
+				claimant, _ := net.Dial("tcp", addr)
+				defer claimant.Close()
+				reader := bufio.NewReader(claimant)
+				fmt.Fprintln(claimant, `{"event": "handshake", "name": "claimant", "room": "den"}`)
+				reader.ReadString('\n') // handshake_response
+				reader.ReadString('\n') // own user_joined broadcast
+
+				host.Close()
+
+				claimant.SetReadDeadline(time.Now().Add(1 * time.Second))
+				reply, _ := reader.ReadString('\n')
+				if !strings.Contains(reply, "no_host") {
+					t.Fatalf("expected no_host broadcast, got: %s", reply)
+				}
+
+				if id, _ := roomHost(server, "den"); id != -1 {
+					t.Fatal("PolicyExplicit auto-promoted a host")
+				}
+
+				// A client claims host explicitly.
+				fmt.Fprintln(claimant, `{"event": "request_host"}`)
+				waitForHost(t, server, "den", "claimant")
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server, addr := startTestServer()
+			server.DefaultHostElectionPolicy = tc.policy
+			tc.run(t, server, addr)
+		})
+	}
+}
+
+func TestTransferHost(t *testing.T) {
+	server, addr := startTestServer()
+
+	host, _ := net.Dial("tcp", addr)
+	defer host.Close()
+	fmt.Fprintln(host, `{"event": "handshake", "name": "host", "host": true, "room": "den"}`)
+	bufio.NewReader(host).ReadString('\n')
+
+	target, _ := net.Dial("tcp", addr)
+	defer target.Close()
+	fmt.Fprintln(target, `{"event": "handshake", "name": "target", "room": "den"}`)
+	bufio.NewReader(target).ReadString('\n') // handshake_response
+
+	id := clientIDByName(server, "den", "target")
+	fmt.Fprintf(host, `{"event": "transfer_host", "target_id": %d}`+"\n", id)
+
+	waitForHost(t, server, "den", "target")
+}
+
+func TestTransferHostRejectsNonHost(t *testing.T) {
+	server, addr := startTestServer()
+
+	host, _ := net.Dial("tcp", addr)
+	defer host.Close()
+	fmt.Fprintln(host, `{"event": "handshake", "name": "host", "host": true, "room": "den"}`)
+	bufio.NewReader(host).ReadString('\n')
+
+	other, _ := net.Dial("tcp", addr)
+	defer other.Close()
+	reader := bufio.NewReader(other)
+	fmt.Fprintln(other, `{"event": "handshake", "name": "other", "room": "den"}`)
+	reader.ReadString('\n') // handshake_response
+	reader.ReadString('\n') // own user_joined
+
+	fmt.Fprintln(other, `{"event": "transfer_host", "target_id": 0}`)
+	reply, _ := reader.ReadString('\n')
+	if !strings.Contains(reply, "Only the host can transfer host") {
+		t.Fatalf("expected rejection of a non-host transfer_host, got: %s", reply)
+	}
+
+	if id, _ := roomHost(server, "den"); id != 0 {
+		t.Error("host changed despite the transfer_host coming from a non-host")
+	}
+}
+
+// clientIDByName synchronously looks up a client's room-scoped ID by name.
+func clientIDByName(server *Server, roomID, name string) int {
+	done := make(chan int)
+	server.actions <- func() {
+		room, ok := server.Rooms[roomID]
+		if !ok {
+			done <- -1
+			return
+		}
+		room.actions <- func() {
+			for _, c := range room.Clients {
+				if c.Name == name {
+					done <- c.ID
+					return
+				}
+			}
+			done <- -1
+		}
+	}
+	return <-done
+}
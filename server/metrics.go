@@ -0,0 +1,72 @@
+package main
+
+import (
+	"expvar"
+	"io"
+)
+
+// Packet drop reasons, published under Metrics.PacketsDropped.
+const (
+	DropQueueFull    = "queue_full"
+	DropWriteTimeout = "write_timeout"
+	DropUnknownHost  = "unknown_host"
+	DropOversize     = "oversize"
+	DropBadJSON      = "bad_json"
+)
+
+// Metrics is Server's expvar instrumentation, modeled on the counters
+// Tailscale's DERP server publishes: wire-level traffic counters, a
+// breakdown of why packets got dropped, and gauges for the things an
+// operator wants at a glance. Every field is safe for concurrent use.
+type Metrics struct {
+	PacketsSent expvar.Int
+	BytesSent   expvar.Int
+	PacketsRecv expvar.Int
+	BytesRecv   expvar.Int
+	// PacketsDropped is keyed by drop reason (DropQueueFull, etc).
+	PacketsDropped expvar.Map
+
+	ActiveClients   expvar.Int
+	ActiveRooms     expvar.Int
+	PendingRequests expvar.Int
+}
+
+// NewMetrics builds a zeroed Metrics with PacketsDropped pre-seeded, so
+// /debug/vars lists every drop reason even before it's ever happened.
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.PacketsDropped.Init()
+	for _, reason := range []string{DropQueueFull, DropWriteTimeout, DropUnknownHost, DropOversize, DropBadJSON} {
+		m.PacketsDropped.Add(reason, 0)
+	}
+	return m
+}
+
+// ExpVar returns m as an expvar.Var, for expvar.Publish("live", ...).
+func (m *Metrics) ExpVar() expvar.Var {
+	v := new(expvar.Map).Init()
+	v.Set("packets_sent", &m.PacketsSent)
+	v.Set("bytes_sent", &m.BytesSent)
+	v.Set("packets_recv", &m.PacketsRecv)
+	v.Set("bytes_recv", &m.BytesRecv)
+	v.Set("packets_dropped", &m.PacketsDropped)
+	v.Set("active_clients", &m.ActiveClients)
+	v.Set("active_rooms", &m.ActiveRooms)
+	v.Set("pending_requests", &m.PendingRequests)
+	return v
+}
+
+// countingReader wraps r, adding every byte read to metric. Used to track
+// BytesRecv without threading counting through each Codec's ReadMessage.
+type countingReader struct {
+	r      io.Reader
+	metric *expvar.Int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.metric.Add(int64(n))
+	}
+	return n, err
+}
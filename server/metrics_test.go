@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPacketsDroppedQueueFull(t *testing.T) {
+	server := NewServer()
+	server.SendQueueDepth = 1
+	go server.run()
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleConnection(conn)
+		}
+	}()
+	addr := listener.Addr().String()
+
+	// Slow client: connects and never reads again, wedging its write path
+	// once the kernel send buffer fills up - same technique as
+	// TestSlowClientDroppedWithoutBlockingBroadcast. Small writes against
+	// an empty kernel buffer succeed instantly and never build the
+	// backpressure needed to force a head-drop.
+	slow, _ := net.Dial("tcp", addr)
+	defer slow.Close()
+	fmt.Fprintln(slow, `{"event": "handshake", "name": "slow", "room": "den"}`)
+
+	fast, _ := net.Dial("tcp", addr)
+	defer fast.Close()
+	fmt.Fprintln(fast, `{"event": "handshake", "name": "fast", "room": "den"}`)
+	reader := bufio.NewReader(fast)
+	reader.ReadString('\n') // own handshake_response
+	reader.ReadString('\n') // slow's user_joined broadcast
+
+	payload := strings.Repeat("x", 8192)
+	go func() {
+		for i := 0; i < 500; i++ {
+			fmt.Fprintf(fast, `{"event": "update_content", "content": "%s"}`+"\n", payload)
+		}
+	}()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if dropped, ok := server.Metrics.PacketsDropped.Get(DropQueueFull).(interface{ Value() int64 }); ok && dropped.Value() > 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("packetsDropped{reason=queue_full} did not increment when a client's send queue overflowed")
+}
+
+func TestMetricsGaugesTrackRoomLifecycle(t *testing.T) {
+	server, addr := startTestServer()
+
+	conn, _ := net.Dial("tcp", addr)
+	fmt.Fprintln(conn, `{"event": "handshake", "name": "gauge-test", "room": "den"}`)
+	bufio.NewReader(conn).ReadString('\n') // handshake_response
+
+	if got := server.Metrics.ActiveRooms.Value(); got != 1 {
+		t.Errorf("ActiveRooms = %d, want 1 after room creation", got)
+	}
+	if got := server.Metrics.ActiveClients.Value(); got != 1 {
+		t.Errorf("ActiveClients = %d, want 1 after join", got)
+	}
+
+	conn.Close()
+	deadline := time.Now().Add(1 * time.Second)
+	for time.Now().Before(deadline) && server.Metrics.ActiveClients.Value() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := server.Metrics.ActiveClients.Value(); got != 0 {
+		t.Errorf("ActiveClients = %d, want 0 after disconnect", got)
+	}
+}
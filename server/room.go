@@ -0,0 +1,237 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Room holds everything scoped to one collaborative session: its own
+// clients, pending host requests, ID counters, and action queue. Like
+// Server, a Room serializes all state access through its own actions
+// channel, so operations in one room never block another.
+type Room struct {
+	ID              string
+	Clients         map[int]*Client
+	PendingRequests map[int]*PendingRequest
+	Host            *Client
+	NextClientID    int
+	NextRequestID   int
+	// HostElectionPolicy governs who removeClient falls back to promoting
+	// when the current host leaves without an explicit transfer_host.
+	HostElectionPolicy HostElectionPolicy
+	actions            chan func()
+
+	server *Server
+}
+
+func (r *Room) run() {
+	for action := range r.actions {
+		action()
+	}
+}
+
+func (r *Room) dispatch(fn func()) {
+	r.actions <- fn
+}
+
+func (r *Room) sync(fn func()) {
+	done := make(chan struct{})
+	r.actions <- func() {
+		fn()
+		close(done)
+	}
+	<-done
+}
+
+// registerClient finishes the handshake for a client that has just been
+// routed into this room: it assigns a room-scoped ID, claims host if
+// requested and free, and announces the join.
+func (r *Room) registerClient(client *Client, name string, wantsHost bool) {
+	client.ID = r.NextClientID
+	r.NextClientID++
+	client.Name = name
+
+	if wantsHost && r.Host == nil {
+		client.IsHost = true
+		r.Host = client
+		r.flushQueuedRequests(client)
+	}
+
+	r.Clients[client.ID] = client
+	r.server.Metrics.ActiveClients.Add(1)
+
+	sendJSON(client, map[string]any{
+		"event": "handshake_response", "id": client.ID, "room": r.ID, "is_host": client.IsHost,
+	})
+	r.broadcast(nil, map[string]any{
+		"event": "user_joined", "id": client.ID, "name": client.Name, "is_host": client.IsHost,
+	})
+}
+
+func (r *Room) processMessage(client *Client, msg map[string]any) {
+
+	// TODO: Handle non-string (malformed) fields, now expecting everything to be string
+	event, _ := msg["event"].(string)
+
+	// Already joined this room; repeat handshakes are a no-op.
+	if event == "handshake" {
+		return
+	}
+
+	// Handle standard broadcasts
+	if event == "cursor_move" || event == "update_content" || event == "cursor_leave" {
+		msg["from_id"] = client.ID
+		msg["name"] = client.Name
+		r.broadcast(client, msg)
+		return
+	}
+
+	if event == "transfer_host" {
+		r.handleTransferHost(client, msg)
+		return
+	}
+	if event == "request_host" {
+		r.handleRequestHost(client, msg)
+		return
+	}
+
+	if reqIDFloat, ok := msg["request_id"].(float64); ok {
+		reqID := int(reqIDFloat)
+
+		pending, exists := r.PendingRequests[reqID]
+		if exists {
+			pending.Timer.Stop()
+			delete(r.PendingRequests, reqID)
+			r.server.Metrics.PendingRequests.Add(-1)
+
+			if target, ok := r.Clients[pending.ClientID]; ok {
+				sendJSON(target, msg)
+			}
+		} else if reqID != 0 {
+			log.Printf("Host replied to expired/unknown request id %d in room %q", reqID, r.ID)
+		}
+		return
+	}
+
+	reqID := r.NextRequestID
+	r.NextRequestID++
+
+	pending := &PendingRequest{
+		ClientID:  client.ID,
+		RequestID: reqID,
+	}
+
+	pending.Timer = time.AfterFunc(RequestTimeout, func() {
+		r.dispatch(func() { r.handleTimeout(reqID) })
+	})
+	r.PendingRequests[reqID] = pending
+
+	msg["request_id"] = reqID
+	msg["from_id"] = client.ID
+
+	switch {
+	case r.Host != nil:
+		sendJSON(r.Host, msg)
+		pending.Delivered = true
+		r.server.Metrics.PendingRequests.Add(1)
+	case r.HostElectionPolicy == PolicyExplicit:
+		// No host to send to yet; hold onto it until one claims host
+		// (flushQueuedRequests) or it times out.
+		pending.Msg = msg
+		r.server.Metrics.PendingRequests.Add(1)
+	default:
+		sendJSON(client, map[string]any{"event": "error", "message": "No host available :(((("})
+		r.server.Metrics.PacketsDropped.Add(DropUnknownHost, 1)
+
+		pending.Timer.Stop()
+		delete(r.PendingRequests, reqID)
+	}
+}
+
+func (r *Room) removeClient(client *Client) {
+	if _, ok := r.Clients[client.ID]; !ok {
+		return
+	}
+
+	delete(r.Clients, client.ID)
+	r.server.Metrics.ActiveClients.Add(-1)
+
+	for id, req := range r.PendingRequests {
+		if req.ClientID == client.ID {
+			req.Timer.Stop()
+			delete(r.PendingRequests, id)
+			r.server.Metrics.PendingRequests.Add(-1)
+		}
+	}
+
+	// Fall back to the room's election policy if the departing client was
+	// host; an explicit transfer_host always takes priority while they're
+	// still around.
+	if r.Host == client {
+		if next := r.electCandidate(); next != nil {
+			r.setHost(next)
+		} else {
+			r.Host = nil
+			r.cancelDeliveredRequests()
+			r.broadcast(nil, map[string]any{"event": "no_host"})
+		}
+	}
+
+	r.broadcast(client, map[string]any{
+		"event": "user_left", "id": client.ID, "name": client.Name,
+	})
+
+	if len(r.Clients) == 0 {
+		roomID := r.ID
+		time.AfterFunc(r.server.RoomIdleTimeout, func() {
+			r.server.dispatch(func() { r.server.reapRoomIfEmpty(roomID) })
+		})
+	}
+}
+
+func (r *Room) handleTimeout(reqID int) {
+	req, ok := r.PendingRequests[reqID]
+	if !ok {
+		return
+	}
+
+	if client, ok := r.Clients[req.ClientID]; ok {
+		sendJSON(client, map[string]any{
+			"event":   "error",
+			"message": "Timeout! Host is too incompetent",
+		})
+	}
+
+	delete(r.PendingRequests, reqID)
+	r.server.Metrics.PendingRequests.Add(-1)
+}
+
+// broadcast sends data to every client in the room except sender (nil sends
+// to everyone). Recipients on different codecs get independently encoded,
+// so a binary and a JSON client in the same room each see their own wire
+// format; each distinct codec is only encoded once per call.
+func (r *Room) broadcast(sender *Client, data map[string]any) {
+	type encoded struct {
+		bytes []byte
+		err   error
+	}
+	cache := make(map[Codec]encoded)
+
+	for _, c := range r.Clients {
+		if sender != nil && c.ID == sender.ID {
+			continue
+		}
+
+		enc, ok := cache[c.Codec]
+		if !ok {
+			bytes, err := c.Codec.EncodeMessage(c, data)
+			enc = encoded{bytes: bytes, err: err}
+			cache[c.Codec] = enc
+		}
+		if enc.err != nil {
+			log.Printf("Error encoding message for broadcast: %v", enc.err)
+			continue
+		}
+		enqueue(c, enc.bytes)
+	}
+}
@@ -2,14 +2,11 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
 	"errors"
-	"flag"
-	"fmt"
 	"io"
 	"log"
 	"net"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,6 +15,13 @@ const (
 	RequestTimeout = 5 * time.Second
 	// 5MB hard file size limit
 	MaxBufferSize = 5 * 1024 * 1024
+
+	// Defaults for Server.WriteTimeout / KeepAliveInterval / SendQueueDepth
+	DefaultWriteTimeout      = 2 * time.Second
+	DefaultKeepAliveInterval = 30 * time.Second
+	DefaultSendQueueDepth    = 64
+	// Default for Server.RoomIdleTimeout
+	DefaultRoomIdleTimeout = 5 * time.Minute
 )
 
 type Client struct {
@@ -25,6 +29,23 @@ type Client struct {
 	ID     int
 	Name   string
 	IsHost bool
+	// Room this client has joined, nil until its handshake names one.
+	Room *Room
+	// Codec this connection reads and writes, chosen by sniffing the first
+	// byte read from it. Defaults to JSONCodec until that happens, so an
+	// early keepalive ping has something valid to encode with.
+	Codec Codec
+	// Metrics is the server-wide instrumentation this client reports into.
+	Metrics *Metrics
+	// LastActivity is the unix-nano time of the last message read from this
+	// client, used by the /debug status page. Read/written from different
+	// goroutines (reader loop, debug HTTP handler), hence atomic.
+	LastActivity atomic.Int64
+	// CloseAfterSend tells writeLoop to close the connection once it has
+	// flushed whatever's currently queued, instead of the caller closing
+	// Conn directly - a direct close would race the writer and could tear
+	// down the socket before a just-enqueued error frame is ever written.
+	CloseAfterSend atomic.Bool
 	// Channel buffer for messages, ONLY WRITE TO THIS
 	Send chan []byte
 	// Signal channel for writer (signals close)
@@ -35,342 +56,403 @@ type PendingRequest struct {
 	ClientID  int
 	RequestID int
 	Timer     *time.Timer
+	// Msg is the original request, kept so it can be forwarded once a host
+	// becomes available. Only set while Delivered is false.
+	Msg map[string]any
+	// Delivered reports whether Msg was already sent to a host (true in
+	// the common case; false only while queued under PolicyExplicit with
+	// no host to send it to yet).
+	Delivered bool
 }
 
+// Server owns the directory of rooms and the connections that haven't
+// joined one yet. Like Room, it serializes all state access through its own
+// actions channel so the rest of the code stays lock-free.
 type Server struct {
-	Clients         map[int]*Client
-	PendingRequests map[int]*PendingRequest
-	NextClientID    int
-	NextRequestID   int
-	mu              sync.RWMutex
+	Rooms   map[string]*Room
+	Metrics *Metrics
+	actions chan func()
+
+	// Tokens gates room access by pre-shared token, keyed by room ID. Nil
+	// (the default) disables token auth, so a handshake with no "token"
+	// field still succeeds.
+	Tokens TokenConfig
+
+	// WriteTimeout bounds how long a single conn.Write may take before the
+	// client is dropped as stalled.
+	WriteTimeout time.Duration
+	// KeepAliveInterval is how often an idle writer sends a "ping" event, and
+	// (at twice this interval) how long the reader waits before treating the
+	// connection as dead.
+	KeepAliveInterval time.Duration
+	// SendQueueDepth is the size of each client's outbound buffer before
+	// sendJSON/broadcast start head-dropping.
+	SendQueueDepth int
+	// RoomIdleTimeout is how long a room is kept around with no clients
+	// before it's garbage-collected.
+	RoomIdleTimeout time.Duration
+	// DefaultHostElectionPolicy seeds the HostElectionPolicy of every room
+	// created from here on.
+	DefaultHostElectionPolicy HostElectionPolicy
 }
 
-var server = Server{
-	Clients:         make(map[int]*Client),
-	PendingRequests: make(map[int]*PendingRequest),
+func NewServer() *Server {
+	return &Server{
+		Rooms:                     make(map[string]*Room),
+		Metrics:                   NewMetrics(),
+		actions:                   make(chan func()),
+		WriteTimeout:              DefaultWriteTimeout,
+		KeepAliveInterval:         DefaultKeepAliveInterval,
+		SendQueueDepth:            DefaultSendQueueDepth,
+		RoomIdleTimeout:           DefaultRoomIdleTimeout,
+		DefaultHostElectionPolicy: PolicyOldest,
+	}
 }
 
-func main() {
-	portPtr := flag.String("port", "8080", "")
-	flag.Parse()
-	address := ":" + *portPtr
-
-	server := &Server{
-		Clients:         make(map[int]*Client),
-		PendingRequests: make(map[int]*PendingRequest),
+// run processes queued actions one at a time until the server is torn down.
+func (s *Server) run() {
+	for action := range s.actions {
+		action()
 	}
+}
 
-	listener, err := net.Listen("tcp", address)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer listener.Close()
-	fmt.Printf("Listening on %s\n", address)
+// dispatch queues fn to run on the server goroutine without waiting for it.
+func (s *Server) dispatch(fn func()) {
+	s.actions <- fn
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Println("Accept error:", err)
-			continue
-		}
-		go server.handleConnection(conn)
+// sync queues fn and blocks until it has run, for callers that need state to
+// be settled (e.g. a client's assigned room) before continuing.
+func (s *Server) sync(fn func()) {
+	done := make(chan struct{})
+	s.actions <- func() {
+		fn()
+		close(done)
 	}
+	<-done
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
 	client := &Client{
-		Conn: conn,
-		// 64 slots (24 bytes each, 24x64 is around 1.5 KB) for each client's buffer
-		// If it is full start dropping (connection is usually fatally slow or broken)
-		Send: make(chan []byte, 64),
-		// Signals writer to stop
-		Done: make(chan struct{}),
+		Conn:    conn,
+		Codec:   JSONCodec{},
+		Metrics: s.Metrics,
+		Send:    make(chan []byte, s.SendQueueDepth),
+		Done:    make(chan struct{}),
 	}
+	client.LastActivity.Store(time.Now().UnixNano())
+	defer close(client.Done)
 
-	// Add client metadata
-	s.mu.Lock()
-	client.ID = s.NextClientID
-	s.NextClientID++
+	go s.writeLoop(client)
 
-	// If no other clients, make this the host
-	if len(s.Clients) == 0 {
-		client.IsHost = true
-	}
+	reader := bufio.NewReaderSize(&countingReader{r: conn, metric: &s.Metrics.BytesRecv}, 64*1024)
+	sniffed := false
 
-	s.Clients[client.ID] = client
-	s.mu.Unlock()
-
-	// Writer
-	go func() {
-		defer conn.Close()
-
-		for {
-			select {
-			// From Send buffer write to the actual connection
-			case msg, ok := <-client.Send:
-				if !ok {
-					return
-				}
-				_, err := conn.Write(msg)
-				if err != nil {
-					return
-				}
-			// Signal for writer stop
-			case <-client.Done:
-				return
+	for {
+		// Idle clients get reaped a couple of keepalive intervals after
+		// their last message (pings don't count, they're writer-side only).
+		conn.SetReadDeadline(time.Now().Add(2 * s.KeepAliveInterval))
+
+		if !sniffed {
+			codec, err := detectCodec(reader)
+			if err != nil {
+				break
 			}
+			client.Codec = codec
+			sniffed = true
 		}
-	}()
 
-	// Reader
-	scanner := bufio.NewScanner(conn)
-	// Start with 64KB
-	buf := make([]byte, 0, 64*1024)
-	// Cap to max size
-	scanner.Buffer(buf, MaxBufferSize)
-
-	for scanner.Scan() {
-		var msg map[string]any
-
-		err := json.Unmarshal(scanner.Bytes(), &msg)
+		msg, err := client.Codec.ReadMessage(reader)
 		if err != nil {
-			log.Printf("JSON unmarshal error client %d: %v", client.ID, err)
-			continue
+			var de *decodeError
+			if errors.As(err, &de) {
+				log.Printf("Message decode error: %v", err)
+				s.Metrics.PacketsDropped.Add(DropBadJSON, 1)
+				continue
+			}
+			if errors.Is(err, bufio.ErrTooLong) {
+				log.Print("Client sent too big message")
+				s.Metrics.PacketsDropped.Add(DropOversize, 1)
+			} else if !errors.Is(err, io.EOF) && !isClosedOrTimeout(err) {
+				log.Printf("Read error: %v", err)
+			}
+			break
 		}
 
-		s.processMessage(client, msg)
+		client.LastActivity.Store(time.Now().UnixNano())
+		s.Metrics.PacketsRecv.Add(1)
+		s.routeMessage(client, msg)
 	}
 
-	err := scanner.Err()
-	if err != nil {
-		if errors.Is(err, bufio.ErrTooLong) {
-			log.Printf("Client %d sent too big message", client.ID)
-		} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
-			log.Printf("Read error client %d: %v", client.ID, err)
-		}
+	if client.Room != nil {
+		room := client.Room
+		room.sync(func() { room.removeClient(client) })
 	}
-	s.removeClient(client)
 }
 
-func (s *Server) processMessage(client *Client, msg map[string]any) {
-
-	// TODO: Handle non-string (malformed) fields, now expecting everything to be string
+// routeMessage dispatches a decoded message either to the server (before a
+// client has joined a room, and for room-agnostic admin events) or to the
+// client's room.
+func (s *Server) routeMessage(client *Client, msg map[string]any) {
 	event, _ := msg["event"].(string)
 
-	// Handle handshake
-	if event == "handshake" {
-		newName, ok := msg["name"].(string)
-		// TODO: Add limits
-		if !ok || newName == "" {
-			s.sendJSON(client, map[string]any{"event": "error", "message": "Invalid name"})
-			return
-		}
-
-		s.mu.Lock()
-		if client.Name == "" {
-			client.Name = newName
-			s.mu.Unlock()
-			s.broadcast(nil, map[string]any{
-				"event": "user_joined", "id": client.ID, "name": client.Name, "is_host": client.IsHost,
-			})
-		} else {
-			// If second handshake ignore and unlock mutex to prevent deadlocks
-			s.mu.Unlock()
-		}
+	switch {
+	case event == "room_list":
+		s.sync(func() {
+			sendJSON(client, map[string]any{"event": "room_list", "rooms": s.roomList()})
+		})
+	case event == "room_info":
+		roomID, _ := msg["room"].(string)
+		s.sync(func() {
+			sendJSON(client, s.roomInfo(roomID))
+		})
+	case client.Room == nil:
+		s.sync(func() {
+			s.joinRoom(client, msg)
+		})
+	default:
+		room := client.Room
+		room.sync(func() {
+			room.processMessage(client, msg)
+		})
+	}
+}
 
+// joinRoom handles the handshake for a client that hasn't joined a room
+// yet. It must run on the server's action goroutine.
+func (s *Server) joinRoom(client *Client, msg map[string]any) {
+	event, _ := msg["event"].(string)
+	if event != "handshake" {
+		sendJSON(client, map[string]any{"event": "error", "message": "Join a room first!"})
 		return
 	}
 
-	if client.Name == "" {
-		s.sendJSON(client, map[string]any{"event": "error", "message": "Set name first!"})
+	name, ok := msg["name"].(string)
+	// TODO: Add limits
+	if !ok || name == "" {
+		sendJSON(client, map[string]any{"event": "error", "message": "Invalid name"})
 		return
 	}
 
-	// Handle standard broadcasts
-	if event == "cursor_move" || event == "update_content" || event == "cursor_leave" {
-		msg["from_id"] = client.ID
-		msg["name"] = client.Name
-		s.broadcast(client, msg)
+	roomID, ok := msg["room"].(string)
+	if !ok || roomID == "" {
+		sendJSON(client, map[string]any{"event": "error", "message": "Invalid room"})
 		return
 	}
 
-	if reqIDFloat, ok := msg["request_id"].(float64); ok {
-		reqID := int(reqIDFloat)
+	wantsHost, _ := msg["host"].(bool)
 
-		var target *Client
-		s.mu.Lock()
-		pending, exists := s.PendingRequests[reqID]
-		if exists {
-			target = s.Clients[pending.ClientID]
-
-			pending.Timer.Stop()
-			delete(s.PendingRequests, reqID)
+	if s.Tokens != nil {
+		auth, known := s.Tokens[roomID]
+		token, _ := msg["token"].(string)
+		if !known || !checkToken(token, auth.TokenHash) {
+			sendJSONAndClose(client, map[string]any{"event": "error", "message": "Invalid token"})
+			return
 		}
-		s.mu.Unlock()
-
-		if target != nil {
-			s.sendJSON(target, msg)
-		} else if reqID != 0 {
-			log.Printf("Host replied to expired/unknown request id: %d", reqID)
+		if wantsHost {
+			hostToken, _ := msg["host_token"].(string)
+			if !checkToken(hostToken, auth.HostTokenHash) {
+				sendJSONAndClose(client, map[string]any{"event": "error", "message": "Invalid host token"})
+				return
+			}
 		}
-		return
 	}
 
-	s.mu.Lock()
-	reqID := s.NextRequestID
-	s.NextRequestID++
+	room := s.getOrCreateRoom(roomID)
+	client.Room = room
 
-	pending := &PendingRequest{
-		ClientID:  client.ID,
-		RequestID: reqID,
-	}
-
-	pending.Timer = time.AfterFunc(RequestTimeout, func() {
-		s.handleTimeout(reqID)
+	room.sync(func() {
+		room.registerClient(client, name, wantsHost)
 	})
-	s.PendingRequests[reqID] = pending
-
-	msg["request_id"] = reqID
-	msg["from_id"] = client.ID
+}
 
-	// TODO: Move host to Server struct
-	var host *Client
-	for _, c := range s.Clients {
-		if c.IsHost {
-			host = c
-			break
-		}
+// getOrCreateRoom returns the room with the given ID, starting its action
+// loop if it doesn't exist yet. Must run on the server's action goroutine.
+func (s *Server) getOrCreateRoom(id string) *Room {
+	if room, ok := s.Rooms[id]; ok {
+		return room
 	}
-	s.mu.Unlock()
-
-	if host != nil {
-		s.sendJSON(host, msg)
-	} else {
-		s.sendJSON(client, map[string]any{"event": "error", "message": "No host available :(((("})
-
-		// If no host clean up the pending request
-		s.mu.Lock()
-		p, exists := s.PendingRequests[reqID]
-		if exists {
-			p.Timer.Stop()
-			delete(s.PendingRequests, reqID)
-		}
-		s.mu.Unlock()
+
+	room := &Room{
+		ID:                 id,
+		Clients:            make(map[int]*Client),
+		PendingRequests:    make(map[int]*PendingRequest),
+		HostElectionPolicy: s.DefaultHostElectionPolicy,
+		actions:            make(chan func()),
+		server:             s,
 	}
-}
+	s.Rooms[id] = room
+	s.Metrics.ActiveRooms.Add(1)
+	go room.run()
 
-func (s *Server) removeClient(client *Client) {
-	s.mu.Lock()
+	return room
+}
 
-	// Make sure exits
-	if _, ok := s.Clients[client.ID]; !ok {
-		s.mu.Unlock()
+// reapRoomIfEmpty drops a room from the directory and stops its action loop
+// if it's still empty. Must run on the server's action goroutine.
+func (s *Server) reapRoomIfEmpty(id string) {
+	room, ok := s.Rooms[id]
+	if !ok {
 		return
 	}
 
-	// Close the connection gracefully
-	close(client.Done)
-	delete(s.Clients, client.ID)
+	empty := make(chan bool, 1)
+	room.actions <- func() { empty <- len(room.Clients) == 0 }
+	if <-empty {
+		close(room.actions)
+		delete(s.Rooms, id)
+		s.Metrics.ActiveRooms.Add(-1)
+	}
+}
 
-	// Clear any pending requests
-	for id, req := range s.PendingRequests {
-		if req.ClientID == client.ID {
-			req.Timer.Stop()
-			delete(s.PendingRequests, id)
-		}
+// roomList summarizes every active room. Must run on the server's action
+// goroutine.
+func (s *Server) roomList() []map[string]any {
+	rooms := make([]map[string]any, 0, len(s.Rooms))
+	for id, room := range s.Rooms {
+		count := make(chan int, 1)
+		room.actions <- func() { count <- len(room.Clients) }
+		rooms = append(rooms, map[string]any{"id": id, "clients": <-count})
 	}
+	return rooms
+}
 
-	// Randomly pick new host
-	// TODO: Make not random
-	var newHostName string
-	hasNewHost := false
+// roomInfo describes a single room by ID. Must run on the server's action
+// goroutine.
+func (s *Server) roomInfo(id string) map[string]any {
+	room, ok := s.Rooms[id]
+	if !ok {
+		return map[string]any{"event": "room_info", "room": id, "exists": false}
+	}
 
-	if client.IsHost && len(s.Clients) > 0 {
-		for _, newHost := range s.Clients {
-			newHost.IsHost = true
-			newHostName = newHost.Name
-			hasNewHost = true
-			break
+	type snapshot struct {
+		clients int
+		host    string
+	}
+	result := make(chan snapshot, 1)
+	room.actions <- func() {
+		hostName := ""
+		if room.Host != nil {
+			hostName = room.Host.Name
 		}
+		result <- snapshot{clients: len(room.Clients), host: hostName}
 	}
+	snap := <-result
 
-	// Store client info before unlock
-	leftID := client.ID
-	leftName := client.Name
+	return map[string]any{
+		"event": "room_info", "room": id, "exists": true, "clients": snap.clients, "host": snap.host,
+	}
+}
 
-	s.mu.Unlock()
+// writeLoop owns conn.Write for this client: it applies a write deadline to
+// every frame and emits a "ping" keepalive whenever nothing else was sent for
+// a full KeepAliveInterval. Any write failure (including a deadline timeout)
+// closes the connection, which unwedges the reader loop so removal runs.
+func (s *Server) writeLoop(client *Client) {
+	defer client.Conn.Close()
 
-	s.broadcast(client, map[string]any{
-		"event": "user_left", "id": leftID, "name": leftName,
-	})
+	ticker := time.NewTicker(s.KeepAliveInterval)
+	defer ticker.Stop()
 
-	if hasNewHost {
-		s.broadcast(nil, map[string]any{
-			"event": "new_host", "name": newHostName,
-		})
+	for {
+		select {
+		case msg, ok := <-client.Send:
+			if !ok {
+				return
+			}
+			if err := s.writeWithDeadline(client, msg); err != nil {
+				return
+			}
+			if client.CloseAfterSend.Load() {
+				return
+			}
+			ticker.Reset(s.KeepAliveInterval)
+		case <-ticker.C:
+			// Encoded fresh each tick rather than once upfront: the codec
+			// isn't settled until the reader sniffs the client's first byte.
+			ping, err := client.Codec.EncodeMessage(client, map[string]any{"event": "ping"})
+			if err != nil {
+				log.Printf("Error encoding ping: %v", err)
+				return
+			}
+			if err := s.writeWithDeadline(client, ping); err != nil {
+				return
+			}
+		case <-client.Done:
+			return
+		}
 	}
 }
 
-func (s *Server) handleTimeout(reqID int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	req, ok := s.PendingRequests[reqID]
-	if !ok {
-		return
+func (s *Server) writeWithDeadline(client *Client, msg []byte) error {
+	client.Conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	n, err := client.Conn.Write(msg)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			s.Metrics.PacketsDropped.Add(DropWriteTimeout, 1)
+		}
+		return err
 	}
+	s.Metrics.PacketsSent.Add(1)
+	s.Metrics.BytesSent.Add(int64(n))
+	return nil
+}
 
-	if client, ok := s.Clients[req.ClientID]; ok {
-		s.sendJSON(client, map[string]any{
-			"event":   "error",
-			"message": "Timeout! Host is too incompetent",
-		})
+func isClosedOrTimeout(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return true
 	}
-
-	delete(s.PendingRequests, reqID)
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
-func (s *Server) sendJSON(client *Client, data map[string]any) {
-	bytes, err := json.Marshal(data)
+func sendJSON(client *Client, data map[string]any) {
+	bytes, err := client.Codec.EncodeMessage(client, data)
 	if err != nil {
-		log.Printf("Error marshalling: %v", err)
+		log.Printf("Error encoding message: %v", err)
 		return
 	}
-	bytes = append(bytes, '\n')
 
-	// Prevents locking if client is slow (non-blocking)
+	enqueue(client, bytes)
+}
+
+// sendJSONAndClose sends data like sendJSON, then tells writeLoop to close
+// the connection once it's flushed. Used for rejections (e.g. an invalid
+// token) where the caller needs the client to actually see the error frame
+// before the socket goes away - closing Conn directly from here would race
+// writeLoop and reliably win, dropping the connection before it writes.
+func sendJSONAndClose(client *Client, data map[string]any) {
+	// Set before enqueueing: the channel send below happens-before
+	// writeLoop's receive of this exact message, so by the time it checks
+	// the flag after writing, this store is guaranteed visible.
+	client.CloseAfterSend.Store(true)
+	sendJSON(client, data)
+}
+
+// enqueue pushes bytes onto the client's send buffer. If the buffer is full
+// it head-drops the oldest queued message first, so a stalled client's
+// queueing latency stays bounded instead of growing until the writer drops
+// everything new.
+func enqueue(client *Client, bytes []byte) {
 	select {
 	case client.Send <- bytes:
+		return
 	default:
-		// Dropping (buffer full)
 	}
-}
 
-func (s *Server) broadcast(sender *Client, data map[string]any) {
-	bytes, err := json.Marshal(data)
-	if err != nil {
-		log.Printf("Error marshalling: %v", err)
-		return
-	}
-	bytes = append(bytes, '\n')
-
-	// Minimize locking by getting targets beforehand
-	s.mu.RLock()
-	targets := make([]*Client, 0, len(s.Clients))
-	for _, c := range s.Clients {
-		if sender == nil || c.ID != sender.ID {
-			targets = append(targets, c)
-		}
+	select {
+	case <-client.Send:
+		client.Metrics.PacketsDropped.Add(DropQueueFull, 1)
+	default:
 	}
-	s.mu.RUnlock()
 
-	for _, c := range targets {
-		select {
-		case c.Send <- bytes:
-		default:
-			// Dropping
-		}
+	select {
+	case client.Send <- bytes:
+	default:
+		// Someone else drained/filled it between our two selects; give up
+		// rather than block.
 	}
 }
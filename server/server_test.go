@@ -29,6 +29,21 @@ func startTestServer() (*Server, string) {
 	return server, listener.Addr().String()
 }
 
+// roomClientCount synchronously reads len(room.Clients), or -1 if the room
+// doesn't exist.
+func roomClientCount(server *Server, roomID string) int {
+	done := make(chan int)
+	server.actions <- func() {
+		room, ok := server.Rooms[roomID]
+		if !ok {
+			done <- -1
+			return
+		}
+		room.actions <- func() { done <- len(room.Clients) }
+	}
+	return <-done
+}
+
 func TestMain(m *testing.M) {
 	// Discard logs
 	log.SetOutput(io.Discard)
@@ -40,7 +55,7 @@ func TestValidHandshake(t *testing.T) {
 
 	conn, _ := net.Dial("tcp", addr)
 	defer conn.Close()
-	fmt.Fprintln(conn, `{"event": "handshake", "name": "Kiltti pomeranian"}`)
+	fmt.Fprintln(conn, `{"event": "handshake", "name": "Kiltti pomeranian", "room": "den"}`)
 
 	reply, _ := bufio.NewReader(conn).ReadString('\n')
 	if !strings.Contains(reply, "handshake_response") {
@@ -52,21 +67,13 @@ func TestDisconnect(t *testing.T) {
 	server, addr := startTestServer()
 
 	conn, _ := net.Dial("tcp", addr)
-	fmt.Fprintln(conn, `{"event": "handshake", "name": "Karkaileva kissa"}`)
+	fmt.Fprintln(conn, `{"event": "handshake", "name": "Karkaileva kissa", "room": "den"}`)
 	time.Sleep(20 * time.Millisecond)
 	conn.Close()
 	time.Sleep(20 * time.Millisecond)
 
-	done := make(chan bool)
-	server.actions <- func() {
-		if len(server.Clients) == 0 {
-			done <- true
-		} else {
-			done <- false
-		}
-	}
-	if !<-done {
-		t.Error("Client was not removed from server after disconnect")
+	if count := roomClientCount(server, "den"); count > 0 {
+		t.Errorf("Client was not removed from room after disconnect, got %d", count)
 	}
 }
 
@@ -78,7 +85,7 @@ func TestFragmentation(t *testing.T) {
 	fmt.Fprint(conn, `{"event": "hand`)
 	time.Sleep(50 * time.Millisecond)
 	// Send the other half with newline
-	fmt.Fprintln(conn, `shake", "name": "Fragmentoitu pomeranian"}`)
+	fmt.Fprintln(conn, `shake", "name": "Fragmentoitu pomeranian", "room": "den"}`)
 
 	reply, _ := bufio.NewReader(conn).ReadString('\n')
 	if reply == "" {
@@ -103,10 +110,10 @@ func TestMessageLimits(t *testing.T) {
 
 	done := make(chan int)
 	server.actions <- func() {
-		done <- len(server.Clients)
+		done <- len(server.Rooms)
 	}
 	if <-done > 0 {
-		t.Error("Server did not drop client for exceeding MaxBufferSize")
+		t.Error("Server created a room for a client dropped over MaxBufferSize")
 	}
 }
 
@@ -115,38 +122,104 @@ func TestHostClaiming(t *testing.T) {
 
 	// First client claims host
 	c1, _ := net.Dial("tcp", addr)
-	fmt.Fprintln(c1, `{"event": "handshake", "name": "host", "host": true}`)
+	fmt.Fprintln(c1, `{"event": "handshake", "name": "host", "host": true, "room": "den"}`)
 	bufio.NewReader(c1).ReadString('\n') // Wait for response
 
-	// Verify c1 is host
-	done := make(chan bool)
-	server.actions <- func() {
-		if server.Host != nil && server.Host.Name == "host" && server.Host.IsHost {
-			done <- true
-		} else {
-			done <- false
+	isHost := func(name string) bool {
+		done := make(chan bool)
+		server.actions <- func() {
+			room, ok := server.Rooms["den"]
+			if !ok {
+				done <- false
+				return
+			}
+			room.actions <- func() {
+				done <- room.Host != nil && room.Host.Name == name && room.Host.IsHost
+			}
 		}
+		return <-done
 	}
-	if !<-done {
+
+	if !isHost("host") {
 		t.Fatal("First client failed to claim host")
 	}
 
 	// Second client tries to claim host
 	c2, _ := net.Dial("tcp", addr)
-	fmt.Fprintln(c2, `{"event": "handshake", "name": "roisto", "host": true}`)
+	fmt.Fprintln(c2, `{"event": "handshake", "name": "roisto", "host": true, "room": "den"}`)
 	bufio.NewReader(c2).ReadString('\n')
 
 	// Verify c1 is still host (c2 failed)
-	server.actions <- func() {
-		if server.Host != nil && server.Host.Name == "host" {
-			done <- true
-		} else {
-			done <- false
+	if !isHost("host") {
+		t.Error("Second client stole host status, but shouldn't have")
+	}
+}
+
+func TestPerRoomHostElection(t *testing.T) {
+	server, addr := startTestServer()
+
+	a, _ := net.Dial("tcp", addr)
+	fmt.Fprintln(a, `{"event": "handshake", "name": "a-host", "host": true, "room": "A"}`)
+	bufio.NewReader(a).ReadString('\n')
+
+	b, _ := net.Dial("tcp", addr)
+	fmt.Fprintln(b, `{"event": "handshake", "name": "b-host", "host": true, "room": "B"}`)
+	bufio.NewReader(b).ReadString('\n')
+
+	hostName := func(roomID string) string {
+		done := make(chan string)
+		server.actions <- func() {
+			room, ok := server.Rooms[roomID]
+			if !ok {
+				done <- ""
+				return
+			}
+			room.actions <- func() {
+				if room.Host == nil {
+					done <- ""
+					return
+				}
+				done <- room.Host.Name
+			}
 		}
+		return <-done
 	}
 
-	if !<-done {
-		t.Error("Second client stole host status, but shouldn't have")
+	if got := hostName("A"); got != "a-host" {
+		t.Errorf("room A host = %q, want a-host", got)
+	}
+	if got := hostName("B"); got != "b-host" {
+		t.Errorf("room B host = %q, want b-host", got)
+	}
+}
+
+func TestRoomIsolation(t *testing.T) {
+	_, addr := startTestServer()
+
+	a, _ := net.Dial("tcp", addr)
+	defer a.Close()
+	fmt.Fprintln(a, `{"event": "handshake", "name": "alice", "room": "A"}`)
+	aReader := bufio.NewReader(a)
+	aReader.ReadString('\n') // handshake_response
+	aReader.ReadString('\n') // own user_joined broadcast
+
+	b, _ := net.Dial("tcp", addr)
+	defer b.Close()
+	fmt.Fprintln(b, `{"event": "handshake", "name": "bob", "room": "B"}`)
+	bReader := bufio.NewReader(b)
+	bReader.ReadString('\n') // handshake_response
+	bReader.ReadString('\n') // own user_joined broadcast
+
+	fmt.Fprintln(a, `{"event": "cursor_move", "position": [1, 2]}`)
+
+	a.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := aReader.ReadString('\n'); err == nil {
+		t.Error("sender received its own broadcast")
+	}
+
+	b.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := bReader.ReadString('\n'); err == nil {
+		t.Error("cursor_move from room A leaked into room B")
 	}
 }
 
@@ -155,28 +228,33 @@ func TestRequestTimeoutCleanup(t *testing.T) {
 
 	// Join as host
 	h, _ := net.Dial("tcp", addr)
-	fmt.Fprintln(h, `{"event": "handshake", "name": "host", "host": true}`)
+	fmt.Fprintln(h, `{"event": "handshake", "name": "host", "host": true, "room": "den"}`)
 	bufio.NewReader(h).ReadString('\n') // clear buffer
 
 	// Client that sends request
 	conn, _ := net.Dial("tcp", addr)
-	fmt.Fprintln(conn, `{"event": "handshake", "name": "requester"}`)
+	fmt.Fprintln(conn, `{"event": "handshake", "name": "requester", "room": "den"}`)
 	bufio.NewReader(conn).ReadString('\n') // clear buffer
 
 	// Send request
 	fmt.Fprintln(conn, `{"event": "request_files"}`)
 	time.Sleep(100 * time.Millisecond)
 
-	// Make sure that request was created
-	done := make(chan bool)
-	server.actions <- func() {
-		if len(server.PendingRequests) > 0 {
-			done <- true
-		} else {
-			done <- false
+	pendingCount := func() int {
+		done := make(chan int)
+		server.actions <- func() {
+			room, ok := server.Rooms["den"]
+			if !ok {
+				done <- 0
+				return
+			}
+			room.actions <- func() { done <- len(room.PendingRequests) }
 		}
+		return <-done
 	}
-	if !<-done {
+
+	// Make sure that request was created
+	if pendingCount() == 0 {
 		t.Errorf("Request was never registered (or rejected immediately)")
 	}
 
@@ -184,14 +262,7 @@ func TestRequestTimeoutCleanup(t *testing.T) {
 	time.Sleep(RequestTimeout + 50*time.Millisecond)
 
 	// Make sure that timeout clears the request
-	server.actions <- func() {
-		if len(server.PendingRequests) == 0 {
-			done <- true
-		} else {
-			done <- false
-		}
-	}
-	if !<-done {
+	if pendingCount() != 0 {
 		t.Errorf("Pending request was not cleaned up after timeout")
 	}
 }
@@ -201,13 +272,154 @@ func TestUnauthorizedAccess(t *testing.T) {
 	conn, _ := net.Dial("tcp", addr)
 	defer conn.Close()
 
-	// Try to move cursor WITHOUT handshake
+	// Try to move cursor WITHOUT joining a room
 	fmt.Fprintln(conn, `{"event": "cursor_move", "position": [10,10]}`)
 
 	reply, _ := bufio.NewReader(conn).ReadString('\n')
-	if !strings.Contains(reply, "Set name first!") {
-		t.Fatalf("Server allowed message before handshake: %s", reply)
+	if !strings.Contains(reply, "Join a room first!") {
+		t.Fatalf("Server allowed message before joining a room: %s", reply)
+	}
+}
+
+func TestRoomCleanup(t *testing.T) {
+	server, addr := startTestServer()
+	server.RoomIdleTimeout = 30 * time.Millisecond
+
+	conn, _ := net.Dial("tcp", addr)
+	fmt.Fprintln(conn, `{"event": "handshake", "name": "temp", "room": "den"}`)
+	bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+
+	deadline := time.Now().Add(1 * time.Second)
+	for time.Now().Before(deadline) {
+		done := make(chan bool)
+		server.actions <- func() {
+			_, ok := server.Rooms["den"]
+			done <- ok
+		}
+		if !<-done {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("empty room was not garbage-collected after RoomIdleTimeout")
+}
+
+func TestRoomList(t *testing.T) {
+	_, addr := startTestServer()
+
+	conn, _ := net.Dial("tcp", addr)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprintln(conn, `{"event": "handshake", "name": "lister", "room": "den"}`)
+	reader.ReadString('\n') // handshake_response
+	reader.ReadString('\n') // own user_joined
+
+	fmt.Fprintln(conn, `{"event": "room_list"}`)
+	reply, _ := reader.ReadString('\n')
+	if !strings.Contains(reply, `"id":"den"`) {
+		t.Fatalf("room_list did not include joined room: %s", reply)
+	}
+}
+
+func TestSlowClientDroppedWithoutBlockingBroadcast(t *testing.T) {
+	server := NewServer()
+	server.WriteTimeout = 20 * time.Millisecond
+	go server.run()
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleConnection(conn)
+		}
+	}()
+	addr := listener.Addr().String()
+
+	// Slow client: connects and never reads again, wedging its write path
+	// once the kernel send buffer fills up.
+	slow, _ := net.Dial("tcp", addr)
+	defer slow.Close()
+	fmt.Fprintln(slow, `{"event": "handshake", "name": "slow", "room": "den"}`)
+
+	fast, _ := net.Dial("tcp", addr)
+	defer fast.Close()
+	fmt.Fprintln(fast, `{"event": "handshake", "name": "fast", "room": "den"}`)
+	reader := bufio.NewReader(fast)
+	reader.ReadString('\n') // own handshake_response
+	reader.ReadString('\n') // slow's user_joined broadcast
+
+	payload := strings.Repeat("x", 8192)
+	go func() {
+		for i := 0; i < 500; i++ {
+			fmt.Fprintf(fast, `{"event": "update_content", "content": "%s"}`+"\n", payload)
+		}
+	}()
+
+	fast.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatalf("broadcasts to the fast client stalled while the slow client was wedged: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if count := roomClientCount(server, "den"); count <= 1 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("slow client was not dropped after repeated write timeouts")
+}
+
+func TestKeepAlivePingAndIdleReap(t *testing.T) {
+	server := NewServer()
+	server.KeepAliveInterval = 50 * time.Millisecond
+	go server.run()
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleConnection(conn)
+		}
+	}()
+	addr := listener.Addr().String()
+
+	conn, _ := net.Dial("tcp", addr)
+	defer conn.Close()
+	fmt.Fprintln(conn, `{"event": "handshake", "name": "idle", "room": "den"}`)
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n') // handshake_response
+	reader.ReadString('\n') // own user_joined
+
+	// The client never sends anything else after its handshake, so the
+	// next frame it receives must be a keepalive ping.
+	conn.SetReadDeadline(time.Now().Add(2 * server.KeepAliveInterval))
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("did not receive a keepalive ping: %v", err)
+	}
+	if !strings.Contains(reply, `"event":"ping"`) {
+		t.Fatalf("expected a ping frame, got: %s", reply)
+	}
+
+	// Pings don't reset the reader's read deadline, so with no reply from
+	// the client it should get reaped 2*KeepAliveInterval after its last
+	// real message.
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if count := roomClientCount(server, "den"); count <= 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
 	}
+	t.Fatal("idle client was not reaped after its read deadline elapsed")
 }
 
 func BenchmarkServerSingle(b *testing.B) {
@@ -215,7 +427,7 @@ func BenchmarkServerSingle(b *testing.B) {
 	conn, _ := net.Dial("tcp", addr)
 	defer conn.Close()
 
-	fmt.Fprintln(conn, `{"event": "handshake", "name": "benchmark"}`)
+	fmt.Fprintln(conn, `{"event": "handshake", "name": "benchmark", "room": "den"}`)
 	msg := []byte(`{"event": "cursor_move", "position": [10,10]}` + "\n")
 
 	b.ResetTimer()
@@ -244,7 +456,7 @@ func BenchmarkServerMultiClient(b *testing.B) {
 			b.Fatalf("failed to dial: %v", err)
 		}
 		// Standard clients (no host flag)
-		fmt.Fprintf(c, `{"event": "handshake", "name": "hauva-%d"}`+"\n", i)
+		fmt.Fprintf(c, `{"event": "handshake", "name": "hauva-%d", "room": "den"}`+"\n", i)
 		conns[i] = c
 
 		// Discard stream to keep buffer empty